@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServeArtifacts handles GET /artifacts/{id}. It tars up the finished
+// build's ArtifactsDir and streams it to the client; this is what backs
+// the URL transport.HTTP.Push returns, so a project configured with
+// transport: http can actually be pulled from.
+func (s *Server) ServeArtifacts(w http.ResponseWriter, r *http.Request, jobID string) {
+	readyPath, err := s.findReadyBuildPath(jobID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("no such build %s", jobID), http.StatusNotFound)
+		return
+	}
+
+	artifactsPath := filepath.Join(readyPath, DataDir, ArtifactsDir)
+	tr, err := tarDir(artifactsPath)
+	if err != nil {
+		log.Printf("could not tar artifacts for %s: %s", jobID, err)
+		http.Error(w, "could not read artifacts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if _, err := io.Copy(w, tr); err != nil {
+		log.Printf("could not stream artifacts for %s: %s", jobID, err)
+	}
+}
+
+// findReadyBuildPath locates the ready build path for jobID across every
+// project under s.cfg.BuildPath. Job IDs are unique regardless of
+// project, but which project a build belongs to isn't known from the ID
+// alone (unlike /jobs/{project}/{id}/logs), so this is a directory scan
+// rather than a direct path join.
+//
+// Only the project component is globbed; jobID is joined in literally
+// and checked with os.Stat (which, unlike filepath.Glob, never
+// interprets metacharacters), so a client can't smuggle glob syntax
+// (e.g. "*") into jobID to match, and read the artifacts of, some other
+// job.
+func (s *Server) findReadyBuildPath(jobID string) (string, error) {
+	if jobID == "" || jobID == "." || jobID == ".." || strings.ContainsAny(jobID, `/\`) {
+		return "", fmt.Errorf("invalid job id %q", jobID)
+	}
+
+	projectDirs, err := filepath.Glob(filepath.Join(s.cfg.BuildPath, "*"))
+	if err != nil {
+		return "", err
+	}
+	for _, projectDir := range projectDirs {
+		readyPath := filepath.Join(projectDir, "ready", jobID)
+		if _, err := os.Stat(readyPath); err == nil {
+			return readyPath, nil
+		}
+	}
+	return "", fmt.Errorf("no ready build found for job %s", jobID)
+}
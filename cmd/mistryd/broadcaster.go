@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Broadcaster fans out writes to a dynamic set of subscribers, keyed by
+// job ID. It's used to let build log watchers tail a build's output live,
+// without polling the build log file from disk.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]struct{}
+}
+
+// NewBroadcaster returns a new, empty Broadcaster.
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[string]map[chan []byte]struct{})}
+}
+
+// Writer returns an io.Writer that broadcasts everything written to it to
+// jobID's subscribers. The returned writer never returns an error; a slow
+// or absent subscriber must never block or fail the build.
+func (b *Broadcaster) Writer(jobID string) io.Writer {
+	return &broadcastWriter{b: b, jobID: jobID}
+}
+
+// Subscribe registers a new subscriber for jobID and returns a channel
+// that receives every chunk written for that job from now on, and a
+// function to unsubscribe once the caller is done.
+func (b *Broadcaster) Subscribe(jobID string) (ch chan []byte, unsubscribe func()) {
+	ch = make(chan []byte, 64)
+
+	b.mu.Lock()
+	if b.subs[jobID] == nil {
+		b.subs[jobID] = make(map[chan []byte]struct{})
+	}
+	b.subs[jobID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// only remove ch; don't close it here, since Close may have
+		// already done so (and closed an unbuffered chan is raced
+		// with closing it twice otherwise). Subscribers that care
+		// about completion should rely on the channel being closed,
+		// not on unsubscribe being called.
+		if _, ok := b.subs[jobID][ch]; ok {
+			delete(b.subs[jobID], ch)
+			if len(b.subs[jobID]) == 0 {
+				delete(b.subs, jobID)
+			}
+		}
+	}
+	return ch, unsubscribe
+}
+
+// Close notifies and removes every subscriber of jobID by closing their
+// channel. It's called once a build finishes, so anyone tailing it (live
+// watchers or Work's own coalesce-wait loop) knows to stop waiting.
+func (b *Broadcaster) Close(jobID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[jobID] {
+		close(ch)
+	}
+	delete(b.subs, jobID)
+}
+
+func (b *Broadcaster) broadcast(jobID string, p []byte) {
+	buf := make([]byte, len(p))
+	copy(buf, p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[jobID] {
+		select {
+		case ch <- buf:
+		default:
+			// subscriber is too slow to keep up; drop the chunk
+			// rather than blocking the build.
+		}
+	}
+}
+
+type broadcastWriter struct {
+	b     *Broadcaster
+	jobID string
+}
+
+func (w *broadcastWriter) Write(p []byte) (int, error) {
+	w.b.broadcast(w.jobID, p)
+	return len(p), nil
+}
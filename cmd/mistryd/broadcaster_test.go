@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcasterFanOut(t *testing.T) {
+	b := NewBroadcaster()
+	ch1, unsub1 := b.Subscribe("job1")
+	defer unsub1()
+	ch2, unsub2 := b.Subscribe("job1")
+	defer unsub2()
+
+	b.Writer("job1").Write([]byte("hello"))
+
+	for _, ch := range []chan []byte{ch1, ch2} {
+		select {
+		case chunk := <-ch:
+			if string(chunk) != "hello" {
+				t.Errorf("got chunk %q, want %q", chunk, "hello")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for broadcast chunk")
+		}
+	}
+}
+
+func TestBroadcasterDoesNotCrossJobs(t *testing.T) {
+	b := NewBroadcaster()
+	ch1, unsub1 := b.Subscribe("job1")
+	defer unsub1()
+	ch2, unsub2 := b.Subscribe("job2")
+	defer unsub2()
+
+	b.Writer("job1").Write([]byte("for job1"))
+
+	select {
+	case chunk := <-ch1:
+		if string(chunk) != "for job1" {
+			t.Errorf("got chunk %q, want %q", chunk, "for job1")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for job1's chunk")
+	}
+
+	select {
+	case chunk := <-ch2:
+		t.Fatalf("job2's subscriber unexpectedly received %q", chunk)
+	default:
+	}
+}
+
+func TestBroadcasterSlowSubscriberDoesNotBlockWrite(t *testing.T) {
+	b := NewBroadcaster()
+	_, unsub := b.Subscribe("job1")
+	defer unsub()
+
+	done := make(chan struct{})
+	go func() {
+		// fill the subscriber's buffer (64) and then some, without
+		// ever reading from it; Write must never block on a slow or
+		// absent subscriber.
+		for i := 0; i < 100; i++ {
+			b.Writer("job1").Write([]byte("x"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write blocked on a slow subscriber")
+	}
+}
+
+func TestBroadcasterCloseNotifiesSubscribers(t *testing.T) {
+	b := NewBroadcaster()
+	ch, unsub := b.Subscribe("job1")
+	defer unsub()
+
+	b.Close("job1")
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("expected the channel to be closed with no pending value")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the channel to close")
+	}
+}
+
+func TestBroadcasterUnsubscribeAfterCloseDoesNotPanic(t *testing.T) {
+	b := NewBroadcaster()
+	_, unsub := b.Subscribe("job1")
+
+	b.Close("job1")
+	// unsubscribe must not double-close (or otherwise panic on) a
+	// channel Close already closed.
+	unsub()
+}
+
+func TestBroadcasterConcurrentSubscribeWriteUnsubscribe(t *testing.T) {
+	b := NewBroadcaster()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, unsub := b.Subscribe("job1")
+			defer unsub()
+			for j := 0; j < 10; j++ {
+				b.Writer("job1").Write([]byte("x"))
+			}
+			select {
+			case <-ch:
+			default:
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("concurrent subscribe/write/unsubscribe did not complete (likely a deadlock)")
+	}
+}
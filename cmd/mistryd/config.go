@@ -0,0 +1,20 @@
+package main
+
+import "github.com/skroutz/mistry/pkg/filesystem"
+
+// Config holds the server's configuration, typically loaded from a TOML
+// file at startup.
+type Config struct {
+	Addr         string
+	ProjectsPath string
+	BuildPath    string
+	UID          string
+
+	// Checkpoints enables the CRIU checkpoint/restore build cache: on
+	// top of the existing filesystem-clone cache, a grouped build's
+	// container state is snapshotted and restored by later jobs in the
+	// same group, instead of re-running the image from scratch.
+	Checkpoints bool
+
+	FileSystem filesystem.FileSystem
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Router returns the HTTP router for the mistry server.
+func (s *Server) Router() http.Handler {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/jobs/{project}/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		j := NewJob(s.cfg, vars["project"], vars["id"], "", nil)
+		s.ServeJobLogs(w, r, j)
+	}).Methods("GET")
+
+	r.HandleFunc("/artifacts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.ServeArtifacts(w, r, mux.Vars(r)["id"])
+	}).Methods("GET")
+
+	r.Handle("/metrics", s.metrics.Handler(s.jq.Size)).Methods("GET")
+
+	return r
+}
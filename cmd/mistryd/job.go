@@ -0,0 +1,359 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+	mtypes "github.com/skroutz/mistry/pkg/types"
+)
+
+// DataDir is the name of the directory, relative to a build path, that
+// holds all the data associated with a build (params, cache, artifacts).
+const DataDir = "data"
+
+// CacheDir is the name of the directory, relative to DataDir, that holds
+// the build's persistent cache.
+const CacheDir = "cache"
+
+// ArtifactsDir is the name of the directory, relative to DataDir, that
+// holds the build's artifacts.
+const ArtifactsDir = "artifacts"
+
+// ParamsDir is the name of the directory, relative to DataDir, that holds
+// the params the build was invoked with, one file per param.
+const ParamsDir = "params"
+
+// CheckpointDir is the name of the directory, relative to a build path
+// (a sibling of DataDir), that holds a CRIU checkpoint of the build's
+// container, if checkpointing is enabled for the project.
+const CheckpointDir = "checkpoint"
+
+// BuildResultFname is the name of the file, relative to a build path,
+// that holds the build's serialized types.BuildResult.
+const BuildResultFname = "result.json"
+
+// checkpointIDFname is the name of the file, relative to a checkpoint
+// bundle, that holds the ID of the Docker container it was taken from;
+// RestoreFromCheckpoint needs it to restore into that same container.
+const checkpointIDFname = "container_id"
+
+// Job is a unit of work carried out by the server. It is created upon
+// receiving a build request from a client.
+type Job struct {
+	ID      string
+	Project string
+	Group   string
+	Params  mtypes.Params
+
+	RootBuildPath    string
+	PendingBuildPath string
+	ReadyBuildPath   string
+	LatestBuildPath  string
+
+	BuildLogPath        string
+	BuildResultFilePath string
+
+	// Services are the auxiliary containers (e.g. postgres, redis)
+	// that should be running, linked to the build container, for the
+	// duration of the build. They're declared in the project's
+	// mistry.yml.
+	Services []ServiceSpec
+
+	// ServiceNetworkID is the Docker network j's services (and, once
+	// StartContainer runs, j's build container) are attached to. It's
+	// empty if j has no Services.
+	ServiceNetworkID string
+
+	// ContainerID is the ID of j's build container, set once
+	// StartContainer or RestoreFromCheckpoint has created it. Checkpoint
+	// needs it to know what to snapshot.
+	ContainerID string
+}
+
+// ServiceSpec declares an auxiliary service container that mistry starts
+// before the build container and tears down once the build finishes.
+type ServiceSpec struct {
+	// Name identifies the service within the build; it's also used as
+	// the hostname other containers on the build network reach it by.
+	Name string `yaml:"name"`
+
+	Image string            `yaml:"image"`
+	Env   map[string]string `yaml:"env"`
+}
+
+// CheckpointPath returns the path to j's checkpoint bundle, rooted at
+// buildPath (typically j.PendingBuildPath or j.ReadyBuildPath).
+func (j *Job) CheckpointPath(buildPath string) string {
+	return filepath.Join(buildPath, CheckpointDir)
+}
+
+// NewJob returns a new Job for the given project, ready to be handed to
+// Server.Work, with all its paths derived from cfg's build directory.
+func NewJob(cfg *Config, project, id, group string, params mtypes.Params) *Job {
+	j := &Job{
+		ID:      id,
+		Project: project,
+		Group:   group,
+		Params:  params,
+
+		RootBuildPath: filepath.Join(cfg.BuildPath, project),
+	}
+	j.PendingBuildPath = filepath.Join(j.RootBuildPath, "pending", j.ID)
+	j.ReadyBuildPath = filepath.Join(j.RootBuildPath, "ready", j.ID)
+	if j.Group != "" {
+		j.LatestBuildPath = filepath.Join(j.RootBuildPath, "groups", j.Group, "latest")
+	}
+	j.BuildLogPath = buildLogPath(j.PendingBuildPath)
+	j.BuildResultFilePath = filepath.Join(j.PendingBuildPath, BuildResultFname)
+	return j
+}
+
+// String returns a human-readable representation of j, used in log lines.
+func (j *Job) String() string {
+	return fmt.Sprintf("%s/%s", j.Project, j.ID)
+}
+
+// imageName returns the name j's Docker image is tagged with, so later
+// steps (StartContainer) can reference it without parsing BuildImage's
+// output.
+func (j *Job) imageName() string {
+	return fmt.Sprintf("mistry/%s:%s", j.Project, j.ID)
+}
+
+// containerName returns the name j's build container is created with.
+func (j *Job) containerName() string {
+	return "mistry-" + j.ID
+}
+
+// BuildImage builds the Docker image for j from its project's build
+// context (a Dockerfile and any supporting files under
+// cfg.ProjectsPath/j.Project), tagging it imageName, and writes the
+// build output to out.
+func (j *Job) BuildImage(ctx context.Context, cfg *Config, client *docker.Client, out io.Writer) error {
+	buildCtx, err := tarDir(filepath.Join(cfg.ProjectsPath, j.Project))
+	if err != nil {
+		return fmt.Errorf("could not tar build context: %s", err)
+	}
+
+	resp, err := client.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
+		Tags:   []string{j.imageName()},
+		Remove: true,
+	})
+	if err != nil {
+		return fmt.Errorf("could not build image: %s", err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not stream build output: %s", err)
+	}
+	return nil
+}
+
+// StartContainer creates and starts j's build container from its
+// already-built image, joining it to j.ServiceNetworkID if j declares
+// Services, runs it to completion and returns its exit code. Container
+// output is written to out.
+//
+// If checkpointDir is non-empty, j is checkpointed via CRIU into it
+// right after starting, while its process is still alive: the Docker
+// checkpoint API rejects an already-exited container, so this can't be
+// deferred until after the container finishes running.
+func (j *Job) StartContainer(ctx context.Context, cfg *Config, client *docker.Client, checkpointDir string, out io.Writer) (int, error) {
+	id, err := j.createContainer(ctx, client, cfg.UID)
+	if err != nil {
+		return -1, err
+	}
+	j.ContainerID = id
+
+	err = client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+	if err != nil {
+		return -1, fmt.Errorf("could not start container: %s", err)
+	}
+
+	if checkpointDir != "" {
+		if err := j.Checkpoint(ctx, client, checkpointDir); err != nil {
+			return -1, err
+		}
+	}
+
+	return j.waitContainer(ctx, client, id, out)
+}
+
+// createContainer creates j's build container, mounting its cache and
+// artifacts directories and, if j.ServiceNetworkID is set, joining it.
+func (j *Job) createContainer(ctx context.Context, client *docker.Client, uid string) (string, error) {
+	hostCfg := &dockercontainer.HostConfig{
+		Binds: []string{
+			filepath.Join(j.PendingBuildPath, DataDir, CacheDir) + ":/mistry/cache",
+			filepath.Join(j.PendingBuildPath, DataDir, ArtifactsDir) + ":/mistry/artifacts",
+		},
+	}
+
+	var netCfg *network.NetworkingConfig
+	if j.ServiceNetworkID != "" {
+		netCfg = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				j.networkName(): {},
+			},
+		}
+	}
+
+	resp, err := client.ContainerCreate(ctx,
+		&dockercontainer.Config{Image: j.imageName(), User: uid},
+		hostCfg, netCfg, j.containerName())
+	if err != nil {
+		return "", fmt.Errorf("could not create container: %s", err)
+	}
+	return resp.ID, nil
+}
+
+// waitContainer streams id's output to out until it exits, and returns
+// its exit code.
+func (j *Job) waitContainer(ctx context.Context, client *docker.Client, id string, out io.Writer) (int, error) {
+	logsDone := make(chan error, 1)
+	go func() {
+		r, err := client.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Follow:     true,
+		})
+		if err != nil {
+			logsDone <- err
+			return
+		}
+		defer r.Close()
+		_, err = io.Copy(out, r)
+		logsDone <- err
+	}()
+
+	statusCode, err := client.ContainerWait(ctx, id)
+	if err != nil {
+		return -1, fmt.Errorf("could not wait for container: %s", err)
+	}
+	if err := <-logsDone; err != nil {
+		return -1, fmt.Errorf("could not stream container output: %s", err)
+	}
+	return int(statusCode), nil
+}
+
+// paramsPath returns the path to the param file for k, relative to j's
+// pending build path.
+func (j *Job) paramsPath(k string) string {
+	return filepath.Join(j.PendingBuildPath, DataDir, ParamsDir, k)
+}
+
+// checkpointID is the fixed CRIU checkpoint name mistry uses; a build
+// only ever has one checkpoint, taken right after the container starts.
+const checkpointID = "mistry"
+
+// Checkpoint snapshots j's still-running container into dst using CRIU,
+// via the Docker checkpoint API. The daemon refuses to checkpoint a
+// container that isn't running, so StartContainer calls this immediately
+// after the container starts rather than waiting for it to finish; the
+// checkpoint leaves the container running, so StartContainer can go on
+// to wait for its exit code as usual. A subsequent job in the same Group
+// can then RestoreFromCheckpoint instead of re-running the image from
+// scratch.
+func (j *Job) Checkpoint(ctx context.Context, client *docker.Client, dst string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create checkpoint dir: %s", err)
+	}
+
+	err = client.CheckpointCreate(ctx, j.ContainerID, types.CheckpointCreateOptions{
+		CheckpointID:  checkpointID,
+		CheckpointDir: dst,
+	})
+	if err != nil {
+		return fmt.Errorf("could not create checkpoint: %s", err)
+	}
+
+	// RestoreFromCheckpoint needs j.ContainerID to restore into the same
+	// container CheckpointCreate just snapshotted; persist it alongside
+	// the checkpoint bundle so it survives bootstrapBuildDir's clone.
+	err = ioutil.WriteFile(filepath.Join(dst, checkpointIDFname), []byte(j.ContainerID), 0644)
+	if err != nil {
+		return fmt.Errorf("could not persist checkpointed container id: %s", err)
+	}
+	return nil
+}
+
+// RestoreFromCheckpoint starts the container checkpointed at src instead
+// of running j's image from scratch. It returns the container's exit
+// code, same as StartContainer.
+func (j *Job) RestoreFromCheckpoint(ctx context.Context, cfg *Config, client *docker.Client, src string, out io.Writer) (int, error) {
+	id, err := ioutil.ReadFile(filepath.Join(src, checkpointIDFname))
+	if err != nil {
+		return -1, fmt.Errorf("could not read checkpointed container id: %s", err)
+	}
+	j.ContainerID = string(id)
+
+	err = client.ContainerStart(ctx, j.ContainerID, types.ContainerStartOptions{
+		CheckpointID:  checkpointID,
+		CheckpointDir: src,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("could not restore container from checkpoint: %s", err)
+	}
+
+	return j.waitContainer(ctx, client, j.ContainerID, out)
+}
+
+// tarDir returns a tar archive of root's contents, rooted at root, for
+// use as a Docker build context.
+func tarDir(root string) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "sync"
+
+// NamedLocker hands out per-key locks, used to serialize operations that
+// touch the same project (e.g. bootstrapping its build directories).
+type NamedLocker struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewNamedLocker returns a new, empty NamedLocker.
+func NewNamedLocker() *NamedLocker {
+	return &NamedLocker{locks: make(map[string]*sync.Mutex)}
+}
+
+// Lock locks the mutex associated with key, creating it if necessary.
+func (l *NamedLocker) Lock(key string) {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = new(sync.Mutex)
+		l.locks[key] = lock
+	}
+	l.mu.Unlock()
+	lock.Lock()
+}
+
+// Unlock unlocks the mutex associated with key.
+func (l *NamedLocker) Unlock(key string) {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	l.mu.Unlock()
+	if ok {
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Logger emits structured, one-JSON-object-per-line events describing a
+// build's progress through Work's phases (queued, coalesced, bootstrap,
+// image-build, container-run, finalize), so mistry is observable in
+// production without scraping stderr.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogger returns a new Logger writing events to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Event is a single structured log line.
+type Event struct {
+	Time    string `json:"time"`
+	Phase   string `json:"phase"`
+	JobID   string `json:"job_id"`
+	Project string `json:"project"`
+	Group   string `json:"group,omitempty"`
+
+	DurationMS int64 `json:"duration_ms,omitempty"`
+
+	ExitCode  *int `json:"exit_code,omitempty"`
+	Cached    bool `json:"cached,omitempty"`
+	Coalesced bool `json:"coalesced,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Log writes e to l, stamping its Time. It never returns an error;
+// logging must not be able to fail a build.
+func (l *Logger) Log(e Event) {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf)
+}
+
+// durationMS returns d in whole milliseconds, for Event.DurationMS.
+func durationMS(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
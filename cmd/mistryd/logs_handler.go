@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gorilla/websocket"
+)
+
+var logsUpgrader = websocket.Upgrader{
+	// builds are only ever tailed by trusted clients on the same
+	// network as the server; there's no browser-based CSRF concern
+	// here.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// ServeJobLogs handles GET /jobs/{project}/{id}/logs?follow=1. It demuxes
+// j's Docker-framed build log (see stdcopy) and streams stdout/stderr to
+// the client over a WebSocket as two distinct message types. It always
+// replays the build log file in full first; if follow=1 and the build
+// is still running, it then keeps streaming as the build progresses.
+// follow=1 on an already-finished build is a no-op past the replay:
+// there's nothing left to tail, and the build's broadcaster entry is
+// gone by the time it's finished (see Broadcaster.Close), so there's no
+// live stream to subscribe to.
+func (s *Server) ServeJobLogs(w http.ResponseWriter, r *http.Request, j *Job) {
+	conn, err := logsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("could not upgrade logs connection for %s: %s", j, err)
+		return
+	}
+	defer conn.Close()
+
+	_, statErr := os.Stat(j.ReadyBuildPath)
+	finished := statErr == nil
+	follow := r.URL.Query().Get("follow") == "1" && !finished
+
+	var chunks chan []byte
+	if follow {
+		// subscribe before replaying the on-disk log, not after, so
+		// nothing written between the replay reaching EOF and the
+		// subscribe call is lost. The live stream's tail then
+		// necessarily overlaps what we just replayed (every replayed
+		// byte is written to disk before it's broadcast), which we
+		// dedupe against below by byte count rather than by content.
+		//
+		// Only done for a build that's still running: once a build
+		// finishes, Work's deferred s.logs.Close(j.ID) has already
+		// removed its broadcaster entry, so Subscribe here would
+		// hand back a channel that's never written to and never
+		// closed, hanging this handler (and its WebSocket) forever.
+		var unsubscribe func()
+		chunks, unsubscribe = s.logs.Subscribe(j.ID)
+		defer unsubscribe()
+	}
+
+	logPath := j.BuildLogPath
+	if finished {
+		// the build already finished; its log lives next to the
+		// result file in the ready path, not the pending one.
+		logPath = buildLogPath(j.ReadyBuildPath)
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("could not open build log for %s: %s", j, err)
+		return
+	}
+	var replayed int64
+	if f != nil {
+		defer f.Close()
+		cr := &countingReader{r: f}
+		err = demux(cr, conn)
+		replayed = cr.n
+		if err != nil {
+			log.Printf("could not replay build log for %s: %s", j, err)
+			return
+		}
+	}
+
+	if !follow {
+		return
+	}
+
+	skip := replayed
+	for chunk := range chunks {
+		if skip > 0 {
+			if int64(len(chunk)) <= skip {
+				skip -= int64(len(chunk))
+				continue
+			}
+			chunk = chunk[skip:]
+			skip = 0
+		}
+		err = demux(bytes.NewReader(chunk), conn)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// countingReader wraps r, tracking the total number of bytes read from
+// it, so ServeJobLogs can skip the live stream's overlap with what it
+// already replayed from disk.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// demux reads Docker stdcopy-framed data from r and writes each frame to
+// conn as its own WebSocket message, tagged by stream (stdout/stderr) so
+// clients can tell them apart.
+func demux(r io.Reader, conn *websocket.Conn) error {
+	stdout := &wsStream{conn: conn, stream: "stdout"}
+	stderr := &wsStream{conn: conn, stream: "stderr"}
+	_, err := stdcopy.StdCopy(stdout, stderr, r)
+	return err
+}
+
+// wsStream adapts a tagged WebSocket text message stream to an io.Writer,
+// so it can be used as a stdcopy.StdCopy destination.
+type wsStream struct {
+	conn   *websocket.Conn
+	stream string
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	msg := append([]byte(s.stream+": "), p...)
+	err := s.conn.WriteMessage(websocket.TextMessage, msg)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func buildLogPath(dir string) string {
+	return filepath.Join(dir, "out.log")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics collects counters and phase durations for the worker, exposed
+// by Handler in Prometheus text exposition format so mistry can be
+// scraped instead of grepped.
+type Metrics struct {
+	mu sync.Mutex
+
+	jobsTotal     map[jobResultKey]int64
+	coalesceHits  map[string]int64
+	cacheHits     map[string]int64
+	phaseDuration map[string]*durationSum
+}
+
+type jobResultKey struct {
+	project string
+	result  string
+}
+
+type durationSum struct {
+	count int64
+	sum   time.Duration
+}
+
+// NewMetrics returns a new, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		jobsTotal:     make(map[jobResultKey]int64),
+		coalesceHits:  make(map[string]int64),
+		cacheHits:     make(map[string]int64),
+		phaseDuration: make(map[string]*durationSum),
+	}
+}
+
+// ObserveJob records a finished job for project, with result typically
+// "success" or "error".
+func (m *Metrics) ObserveJob(project, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobsTotal[jobResultKey{project, result}]++
+}
+
+// ObserveCoalesceHit records that a job for project was coalesced into
+// an already in-progress build instead of starting its own.
+func (m *Metrics) ObserveCoalesceHit(project string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.coalesceHits[project]++
+}
+
+// ObserveCacheHit records that a job for project was served straight
+// from an existing ready build (buildResult.Cached).
+func (m *Metrics) ObserveCacheHit(project string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cacheHits[project]++
+}
+
+// ObservePhase records that phase took d to complete.
+func (m *Metrics) ObservePhase(phase string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ds, ok := m.phaseDuration[phase]
+	if !ok {
+		ds = &durationSum{}
+		m.phaseDuration[phase] = ds
+	}
+	ds.count++
+	ds.sum += d
+}
+
+// Handler returns the /metrics endpoint for m. queueDepth is called on
+// every scrape to report the live size of the in-progress job queue.
+func (m *Metrics) Handler(queueDepth func() int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		fmt.Fprintln(w, "# HELP mistry_queue_depth Number of builds currently in progress.")
+		fmt.Fprintln(w, "# TYPE mistry_queue_depth gauge")
+		fmt.Fprintf(w, "mistry_queue_depth %d\n", queueDepth())
+
+		fmt.Fprintln(w, "# HELP mistry_jobs_total Total number of finished build jobs, by project and result.")
+		fmt.Fprintln(w, "# TYPE mistry_jobs_total counter")
+		keys := make([]jobResultKey, 0, len(m.jobsTotal))
+		for k := range m.jobsTotal {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].project != keys[j].project {
+				return keys[i].project < keys[j].project
+			}
+			return keys[i].result < keys[j].result
+		})
+		for _, k := range keys {
+			fmt.Fprintf(w, "mistry_jobs_total{project=%q,result=%q} %d\n", k.project, k.result, m.jobsTotal[k])
+		}
+
+		fmt.Fprintln(w, "# HELP mistry_coalesce_hits_total Number of jobs coalesced into an already in-progress build.")
+		fmt.Fprintln(w, "# TYPE mistry_coalesce_hits_total counter")
+		for _, project := range sortedCounterKeys(m.coalesceHits) {
+			fmt.Fprintf(w, "mistry_coalesce_hits_total{project=%q} %d\n", project, m.coalesceHits[project])
+		}
+
+		fmt.Fprintln(w, "# HELP mistry_cache_hits_total Number of jobs served from an existing ready build.")
+		fmt.Fprintln(w, "# TYPE mistry_cache_hits_total counter")
+		for _, project := range sortedCounterKeys(m.cacheHits) {
+			fmt.Fprintf(w, "mistry_cache_hits_total{project=%q} %d\n", project, m.cacheHits[project])
+		}
+
+		fmt.Fprintln(w, "# HELP mistry_phase_duration_ms Cumulative time spent in each build phase, in milliseconds.")
+		fmt.Fprintln(w, "# TYPE mistry_phase_duration_ms summary")
+		phases := make([]string, 0, len(m.phaseDuration))
+		for phase := range m.phaseDuration {
+			phases = append(phases, phase)
+		}
+		sort.Strings(phases)
+		for _, phase := range phases {
+			ds := m.phaseDuration[phase]
+			fmt.Fprintf(w, "mistry_phase_duration_ms_sum{phase=%q} %d\n", phase, durationMS(ds.sum))
+			fmt.Fprintf(w, "mistry_phase_duration_ms_count{phase=%q} %d\n", phase, ds.count)
+		}
+	})
+}
+
+// sortedCounterKeys returns m's keys sorted, so Handler's output is
+// stable across scrapes.
+func sortedCounterKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
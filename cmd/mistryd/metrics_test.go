@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandlerFormat(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveJob("myproject", "success")
+	m.ObserveJob("myproject", "success")
+	m.ObserveJob("myproject", "error")
+	m.ObserveCoalesceHit("myproject")
+	m.ObserveCacheHit("myproject")
+	m.ObservePhase("image-build", 250*time.Millisecond)
+	m.ObservePhase("image-build", 750*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	m.Handler(func() int { return 3 }).ServeHTTP(rec, req)
+	body := rec.Body.String()
+
+	wantLines := []string{
+		"mistry_queue_depth 3",
+		`mistry_jobs_total{project="myproject",result="error"} 1`,
+		`mistry_jobs_total{project="myproject",result="success"} 2`,
+		`mistry_coalesce_hits_total{project="myproject"} 1`,
+		`mistry_cache_hits_total{project="myproject"} 1`,
+		`mistry_phase_duration_ms_sum{phase="image-build"} 1000`,
+		`mistry_phase_duration_ms_count{phase="image-build"} 2`,
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	for _, want := range []string{
+		"# HELP mistry_queue_depth",
+		"# TYPE mistry_queue_depth gauge",
+		"# HELP mistry_jobs_total",
+		"# TYPE mistry_jobs_total counter",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsHandlerStableOrder(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveJob("zeta", "success")
+	m.ObserveJob("alpha", "success")
+	m.ObserveCoalesceHit("zeta")
+	m.ObserveCoalesceHit("alpha")
+
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		m.Handler(func() int { return 0 }).ServeHTTP(rec, req)
+		outputs = append(outputs, rec.Body.String())
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("expected repeated scrapes to be byte-identical, got:\n%s\n---\n%s", outputs[0], outputs[1])
+	}
+	alphaIdx := strings.Index(outputs[0], `project="alpha"`)
+	zetaIdx := strings.Index(outputs[0], `project="zeta"`)
+	if alphaIdx == -1 || zetaIdx == -1 || alphaIdx > zetaIdx {
+		t.Errorf("expected projects sorted alphabetically in output:\n%s", outputs[0])
+	}
+}
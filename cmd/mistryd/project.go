@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/skroutz/mistry/pkg/transport"
+	"github.com/skroutz/mistry/pkg/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ProjectConfigFname is the name of the per-project configuration file,
+// relative to the project's directory in Config.ProjectsPath.
+const ProjectConfigFname = "mistry.yml"
+
+// ProjectConfig is a project's mistry.yml, unmarshaled.
+type ProjectConfig struct {
+	// Transport selects how this project's build artifacts are
+	// transferred to clients. It defaults to types.Rsync.
+	Transport types.TransportMethod `yaml:"transport"`
+
+	TransportConfig transport.Config `yaml:"transport_config"`
+
+	// Services are the auxiliary containers this project's builds need
+	// running alongside them, e.g. a database to run integration tests
+	// against.
+	Services []ServiceSpec `yaml:"services"`
+
+	// Steps declares the project's build as a DAG of cacheable steps,
+	// instead of the default single opaque container run. It's empty
+	// for projects that don't opt in.
+	Steps []StepSpec `yaml:"steps"`
+}
+
+// LoadProjectConfig reads and parses project's mistry.yml under
+// projectsPath.
+func LoadProjectConfig(projectsPath, project string) (*ProjectConfig, error) {
+	path := filepath.Join(projectsPath, project, ProjectConfigFname)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := new(ProjectConfig)
+	err = yaml.Unmarshal(buf, pc)
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
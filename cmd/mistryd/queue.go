@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// JobQueue keeps track of the jobs currently being built, so identical,
+// concurrently-submitted jobs can be coalesced into a single build.
+type JobQueue struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobQueue returns a new, empty JobQueue.
+func NewJobQueue() *JobQueue {
+	return &JobQueue{jobs: make(map[string]*Job)}
+}
+
+// Add registers j as in-progress and reports whether j was added, i.e.
+// false means an identical job is already building and the caller should
+// wait for it instead.
+func (q *JobQueue) Add(j *Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := q.key(j)
+	if _, ok := q.jobs[key]; ok {
+		return false
+	}
+	q.jobs[key] = j
+	return true
+}
+
+// Delete removes j from the queue.
+func (q *JobQueue) Delete(j *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.jobs, q.key(j))
+}
+
+// Size returns the number of jobs currently building.
+func (q *JobQueue) Size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+func (q *JobQueue) key(j *Job) string {
+	return j.Project + "/" + j.Group
+}
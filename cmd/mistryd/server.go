@@ -0,0 +1,34 @@
+package main
+
+import "os"
+
+// Server is the mistry daemon. It receives build requests, schedules the
+// underlying Docker work and serves back build results and artifacts.
+type Server struct {
+	cfg *Config
+	jq  *JobQueue
+	pq  *NamedLocker
+
+	// logs fans out each running build's output to clients tailing it
+	// over /jobs/{id}/logs, and to Work's own coalesce-wait loop.
+	logs *Broadcaster
+
+	// logger emits one structured JSON event per build phase, so
+	// mistry is observable without scraping stderr.
+	logger *Logger
+
+	// metrics backs the /metrics Prometheus endpoint.
+	metrics *Metrics
+}
+
+// NewServer returns a new Server configured with cfg.
+func NewServer(cfg *Config) *Server {
+	return &Server{
+		cfg:     cfg,
+		jq:      NewJobQueue(),
+		pq:      NewNamedLocker(),
+		logs:    NewBroadcaster(),
+		logger:  NewLogger(os.Stderr),
+		metrics: NewMetrics(),
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+)
+
+// RunningService is a started service container, along with its
+// dedicated log file.
+type RunningService struct {
+	Spec        ServiceSpec
+	ContainerID string
+	logFile     *os.File
+	logsDone    chan struct{}
+}
+
+// networkName returns the name of the per-build Docker network j's
+// services, and once started, j's build container, are attached to.
+func (j *Job) networkName() string {
+	return "mistry-" + j.ID
+}
+
+// StartServices starts a container for each of j's declared services on
+// a fresh, per-build Docker network, so they can reach each other and
+// the build container by service name. Each service's output is
+// captured into its own log file next to j.BuildLogPath. On error, any
+// services already started (and the network) are torn down before
+// returning.
+func (j *Job) StartServices(ctx context.Context, client *docker.Client) ([]*RunningService, error) {
+	if len(j.Services) == 0 {
+		return nil, nil
+	}
+
+	netResp, err := client.NetworkCreate(ctx, j.networkName(), types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create services network: %s", err)
+	}
+	j.ServiceNetworkID = netResp.ID
+
+	var running []*RunningService
+	for _, spec := range j.Services {
+		rs, err := j.startService(ctx, client, spec)
+		if err != nil {
+			j.StopServices(ctx, client, running)
+			return nil, fmt.Errorf("could not start service %q: %s", spec.Name, err)
+		}
+		running = append(running, rs)
+	}
+	return running, nil
+}
+
+// startService pulls spec.Image, starts a single container from it
+// attached to j's services network under the hostname spec.Name, and
+// tees its output to a dedicated log file next to j.BuildLogPath.
+func (j *Job) startService(ctx context.Context, client *docker.Client, spec ServiceSpec) (*RunningService, error) {
+	f, err := os.Create(serviceLogPath(j.BuildLogPath, spec.Name))
+	if err != nil {
+		return nil, fmt.Errorf("could not create log file: %s", err)
+	}
+
+	reader, err := client.ImagePull(ctx, spec.Image, types.ImagePullOptions{})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not pull image %q: %s", spec.Image, err)
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+	reader.Close()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not pull image %q: %s", spec.Image, err)
+	}
+
+	var env []string
+	for k, v := range spec.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	resp, err := client.ContainerCreate(ctx,
+		&container.Config{Image: spec.Image, Env: env},
+		&container.HostConfig{},
+		&network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				j.networkName(): {Aliases: []string{spec.Name}},
+			},
+		},
+		fmt.Sprintf("%s-%s", j.networkName(), spec.Name))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not create container: %s", err)
+	}
+
+	err = client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not start container: %s", err)
+	}
+
+	rs := &RunningService{Spec: spec, ContainerID: resp.ID, logFile: f, logsDone: make(chan struct{})}
+	go rs.streamLogs(ctx, client)
+	return rs, nil
+}
+
+// streamLogs copies rs's container output into rs.logFile until the
+// container stops producing output.
+func (rs *RunningService) streamLogs(ctx context.Context, client *docker.Client) {
+	defer close(rs.logsDone)
+
+	out, err := client.ContainerLogs(ctx, rs.ContainerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		fmt.Fprintf(rs.logFile, "could not attach to service logs: %s\n", err)
+		return
+	}
+	defer out.Close()
+
+	io.Copy(rs.logFile, out)
+}
+
+// StopServices stops and removes every container in running, closes
+// their log files, and removes the build's services network.
+func (j *Job) StopServices(ctx context.Context, client *docker.Client, running []*RunningService) error {
+	if len(running) == 0 && j.ServiceNetworkID == "" {
+		return nil
+	}
+
+	var firstErr error
+	for _, rs := range running {
+		err := client.ContainerStop(ctx, rs.ContainerID, nil)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not stop service %q: %s", rs.Spec.Name, err)
+		}
+
+		err = client.ContainerRemove(ctx, rs.ContainerID, types.ContainerRemoveOptions{Force: true})
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not remove service %q: %s", rs.Spec.Name, err)
+		}
+
+		<-rs.logsDone
+		if err := rs.logFile.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if j.ServiceNetworkID != "" {
+		err := client.NetworkRemove(ctx, j.ServiceNetworkID)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("could not remove services network: %s", err)
+		}
+	}
+
+	return firstErr
+}
+
+func serviceLogPath(buildLogPath, name string) string {
+	return filepath.Join(filepath.Dir(buildLogPath), fmt.Sprintf("service-%s.log", name))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockercontainer "github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// StepsDir is the name of the directory, relative to a build path (a
+// sibling of DataDir), that holds one subdirectory per build step when
+// the project's mistry.yml declares a build-step DAG.
+const StepsDir = "steps"
+
+// stepResultFname is the name of the file, relative to a step's
+// directory, that holds the step's serialized types.StepResult.
+const stepResultFname = "result.json"
+
+// StepSpec declares a single step of a project's build-step DAG,
+// parsed from mistry.yml. Steps are executed in dependency order,
+// derived from Inputs that name another step's Outputs, mirroring the
+// way a Dockerfile's layers depend on one another.
+type StepSpec struct {
+	// Name identifies the step; it also names its directory under
+	// StepsDir.
+	Name  string   `yaml:"name"`
+	Image string   `yaml:"image"`
+	Cmd   []string `yaml:"cmd"`
+
+	// Inputs are paths this step reads. A path of the form
+	// "<step>:<path>" makes this step depend on <step>, and is
+	// resolved against <step>'s output directory once <step> has run.
+	Inputs []string `yaml:"inputs"`
+
+	// Outputs are paths, relative to the step's working directory,
+	// that this step produces and that downstream steps may depend on.
+	Outputs []string `yaml:"outputs"`
+
+	// Params lists which of the build's params this step's cache key
+	// should include. Params not listed here can change without
+	// invalidating the step's cache, e.g. a "test" step's key need not
+	// include a param that only the "build" step reads.
+	Params []string `yaml:"params"`
+}
+
+// stepDir returns the path to step's directory, rooted at buildPath
+// (typically j.PendingBuildPath or j.ReadyBuildPath).
+func stepDir(buildPath, step string) string {
+	return filepath.Join(buildPath, StepsDir, step)
+}
+
+// orderSteps returns steps ordered so that every step appears after the
+// steps its Inputs depend on, or an error if steps has a cycle or an
+// input referencing an unknown step.
+func orderSteps(steps []StepSpec) ([]StepSpec, error) {
+	byName := make(map[string]StepSpec, len(steps))
+	for _, s := range steps {
+		byName[s.Name] = s
+	}
+
+	var (
+		ordered []StepSpec
+		visited = make(map[string]int) // 0 unvisited, 1 in-progress, 2 done
+	)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch visited[name] {
+		case 2:
+			return nil
+		case 1:
+			return fmt.Errorf("steps: cycle detected at %q", name)
+		}
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("steps: unknown step %q", name)
+		}
+		visited[name] = 1
+		for _, in := range s.Inputs {
+			dep, _ := splitStepInput(in)
+			if dep == "" {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visited[name] = 2
+		ordered = append(ordered, s)
+		return nil
+	}
+
+	for _, s := range steps {
+		if err := visit(s.Name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// stepOrder returns the names of steps in dependency order. Callers
+// that already know steps is a valid DAG (e.g. because RunSteps just
+// executed it) can safely ignore the error case, which returns nil.
+func stepOrder(steps []StepSpec) []string {
+	ordered, err := orderSteps(steps)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, len(ordered))
+	for i, s := range ordered {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// splitStepInput splits an input of the form "<step>:<path>" into its
+// step and path parts. If in doesn't reference another step, dep is
+// empty.
+func splitStepInput(in string) (dep, path string) {
+	for i := 0; i < len(in); i++ {
+		if in[i] == ':' {
+			return in[:i], in[i+1:]
+		}
+	}
+	return "", in
+}
+
+// stepCacheKey returns the cache key identifying an invocation of step,
+// given the image it runs as imageID, the build's params, and the
+// content hashes of its resolved inputs (keyed the same way as
+// step.Inputs). Two invocations with the same key are guaranteed to
+// produce the same outputs, so the second one can be skipped in favor
+// of hardlinking the first's.
+func stepCacheKey(imageID string, step StepSpec, params types.Params, inputHashes map[string]string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintln(h, imageID)
+	for _, c := range step.Cmd {
+		fmt.Fprintln(h, c)
+	}
+
+	keys := append([]string{}, step.Params...)
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, params[k])
+	}
+
+	inputs := append([]string{}, step.Inputs...)
+	sort.Strings(inputs)
+	for _, in := range inputs {
+		fmt.Fprintf(h, "%s=%s\n", in, inputHashes[in])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bootstrapStepDir creates step's pending directory under j's pending
+// build path, or, if cacheKey matches an existing ready step directory
+// among siblingReadyDirs, hardlinks that directory's contents instead of
+// running step at all. It reports whether step was served from cache.
+func bootstrapStepDir(j *Job, step StepSpec, cacheKey string, siblingReadyDirs []string) (cached bool, err error) {
+	dst := stepDir(j.PendingBuildPath, step.Name)
+
+	for _, readyDir := range siblingReadyDirs {
+		key, kerr := ioutil.ReadFile(stepCacheKeyPath(readyDir))
+		if kerr != nil {
+			continue
+		}
+		if string(key) != cacheKey {
+			continue
+		}
+
+		// reuse readyDir's outputs instead of running step at all,
+		// the same way a whole build reuses a sibling ready build's
+		// filesystem via hardlinking.
+		if err := hardlinkTree(readyDir, dst); err != nil {
+			return false, fmt.Errorf("steps: could not reuse cached step dir: %s", err)
+		}
+		return true, nil
+	}
+
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return false, fmt.Errorf("steps: could not create step dir: %s", err)
+	}
+	return false, nil
+}
+
+// stepCacheKeyPath returns the path step's cache key is stored at,
+// rooted at buildPath.
+func stepCacheKeyPath(buildPath string) string {
+	return filepath.Join(buildPath, "cache_key")
+}
+
+// hardlinkTree recreates src's directory structure at dst, hardlinking
+// every regular file so dst shares src's content without copying it.
+func hardlinkTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		return os.Link(path, target)
+	})
+}
+
+// hashPath returns the sha256 content hash of the file or directory at
+// path. Directory entries are walked in (stable, sorted) filepath.Walk
+// order and their relative path is mixed into the hash alongside their
+// content, so renaming a file changes the hash even if its bytes don't.
+func hashPath(path string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(h, rel)
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resolveInputPath returns the filesystem path an input of the form
+// "<step>:<path>" or a bare "<path>" refers to: the former is resolved
+// against the dependency step's (already-run) pending directory, the
+// latter against the project's build context.
+func resolveInputPath(cfg *Config, j *Job, in string) string {
+	dep, path := splitStepInput(in)
+	if dep == "" {
+		return filepath.Join(cfg.ProjectsPath, j.Project, path)
+	}
+	return filepath.Join(stepDir(j.PendingBuildPath, dep), path)
+}
+
+// resolveStepImage pulls image and returns its content-addressable ID,
+// so two steps sharing an image tag get the same stable imageID for
+// stepCacheKey purposes even if the tag is later moved to point
+// elsewhere.
+func resolveStepImage(ctx context.Context, client *docker.Client, image string) (string, error) {
+	reader, err := client.ImagePull(ctx, image, dockertypes.ImagePullOptions{})
+	if err != nil {
+		return "", fmt.Errorf("steps: could not pull image %q: %s", image, err)
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+	reader.Close()
+	if err != nil {
+		return "", fmt.Errorf("steps: could not pull image %q: %s", image, err)
+	}
+
+	inspect, _, err := client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("steps: could not inspect image %q: %s", image, err)
+	}
+	return inspect.ID, nil
+}
+
+// runStepContainer creates and runs a container from imageID executing
+// step.Cmd, with dst (step's pending directory) bind-mounted as its
+// working directory, so step.Cmd reads/writes step.Outputs directly
+// into dst, and each of step.Inputs bind-mounted read-only at the same
+// relative path resolveInputPath resolves it to.
+func runStepContainer(ctx context.Context, client *docker.Client, cfg *Config, j *Job, step StepSpec, imageID, dst string, out io.Writer) (int, error) {
+	const workDir = "/mistry/step"
+
+	binds := []string{dst + ":" + workDir}
+	for _, in := range step.Inputs {
+		_, path := splitStepInput(in)
+		binds = append(binds, resolveInputPath(cfg, j, in)+":"+filepath.Join(workDir, path)+":ro")
+	}
+
+	resp, err := client.ContainerCreate(ctx,
+		&dockercontainer.Config{Image: imageID, Cmd: step.Cmd, WorkingDir: workDir, User: cfg.UID},
+		&dockercontainer.HostConfig{Binds: binds},
+		nil, "")
+	if err != nil {
+		return -1, fmt.Errorf("steps: could not create container for %q: %s", step.Name, err)
+	}
+	defer client.ContainerRemove(ctx, resp.ID, dockertypes.ContainerRemoveOptions{Force: true})
+
+	err = client.ContainerStart(ctx, resp.ID, dockertypes.ContainerStartOptions{})
+	if err != nil {
+		return -1, fmt.Errorf("steps: could not start container for %q: %s", step.Name, err)
+	}
+
+	return j.waitContainer(ctx, client, resp.ID, out)
+}
+
+// RunSteps executes j's build-step DAG in dependency order, skipping
+// any step whose cache key matches one of readyStepsDirs (sibling ready
+// builds of the same project, newest first), and returns each step's
+// result keyed by name.
+func (s *Server) RunSteps(ctx context.Context, cfg *Config, j *Job, client *docker.Client, steps []StepSpec, readyStepsDirs []string, out io.Writer) (map[string]types.StepResult, error) {
+	ordered, err := orderSteps(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]types.StepResult, len(ordered))
+	inputHashes := make(map[string]string)
+
+	for _, step := range ordered {
+		imageID, err := resolveStepImage(ctx, client, step.Image)
+		if err != nil {
+			return results, fmt.Errorf("steps: could not resolve image for %q: %s", step.Name, err)
+		}
+
+		for _, in := range step.Inputs {
+			if _, ok := inputHashes[in]; ok {
+				continue
+			}
+			hash, err := hashPath(resolveInputPath(cfg, j, in))
+			if err != nil {
+				return results, fmt.Errorf("steps: could not hash input %q of %q: %s", in, step.Name, err)
+			}
+			inputHashes[in] = hash
+		}
+
+		key, err := stepCacheKey(imageID, step, j.Params, inputHashes)
+		if err != nil {
+			return results, fmt.Errorf("steps: could not compute cache key for %q: %s", step.Name, err)
+		}
+
+		var siblingReadyStepDirs []string
+		for _, dir := range readyStepsDirs {
+			siblingReadyStepDirs = append(siblingReadyStepDirs, stepDir(dir, step.Name))
+		}
+
+		cached, err := bootstrapStepDir(j, step, key, siblingReadyStepDirs)
+		if err != nil {
+			return results, err
+		}
+
+		exitCode := 0
+		if !cached {
+			fmt.Fprintf(out, "--- running step %q ---\n", step.Name)
+			exitCode, err = runStepContainer(ctx, client, cfg, j, step, imageID, stepDir(j.PendingBuildPath, step.Name), out)
+			if err != nil {
+				return results, fmt.Errorf("steps: could not run %q: %s", step.Name, err)
+			}
+		}
+
+		err = ioutil.WriteFile(stepCacheKeyPath(stepDir(j.PendingBuildPath, step.Name)), []byte(key), 0644)
+		if err != nil {
+			return results, fmt.Errorf("steps: could not write cache key for %q: %s", step.Name, err)
+		}
+
+		results[step.Name] = types.StepResult{ExitCode: exitCode, Cached: cached}
+
+		resultPath := filepath.Join(stepDir(j.PendingBuildPath, step.Name), stepResultFname)
+		buf, err := json.Marshal(results[step.Name])
+		if err != nil {
+			return results, fmt.Errorf("steps: could not serialize result for %q: %s", step.Name, err)
+		}
+		err = ioutil.WriteFile(resultPath, buf, 0644)
+		if err != nil {
+			return results, fmt.Errorf("steps: could not write result for %q: %s", step.Name, err)
+		}
+	}
+
+	return results, nil
+}
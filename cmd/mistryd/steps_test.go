@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestOrderSteps(t *testing.T) {
+	steps := []StepSpec{
+		{Name: "test", Inputs: []string{"build:bin"}},
+		{Name: "build"},
+		{Name: "package", Inputs: []string{"test:report", "build:bin"}},
+	}
+
+	ordered, err := orderSteps(steps)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pos := make(map[string]int, len(ordered))
+	for i, s := range ordered {
+		pos[s.Name] = i
+	}
+	if pos["build"] > pos["test"] {
+		t.Errorf("expected build before test, got order %v", pos)
+	}
+	if pos["test"] > pos["package"] {
+		t.Errorf("expected test before package, got order %v", pos)
+	}
+}
+
+func TestOrderStepsCycle(t *testing.T) {
+	steps := []StepSpec{
+		{Name: "a", Inputs: []string{"b:out"}},
+		{Name: "b", Inputs: []string{"a:out"}},
+	}
+
+	_, err := orderSteps(steps)
+	if err == nil {
+		t.Fatal("expected a cycle error, got nil")
+	}
+}
+
+func TestOrderStepsUnknownDependency(t *testing.T) {
+	steps := []StepSpec{
+		{Name: "a", Inputs: []string{"missing:out"}},
+	}
+
+	_, err := orderSteps(steps)
+	if err == nil {
+		t.Fatal("expected an unknown-step error, got nil")
+	}
+}
+
+func TestSplitStepInput(t *testing.T) {
+	tests := []struct {
+		in       string
+		dep      string
+		wantPath string
+	}{
+		{"build:bin/app", "build", "bin/app"},
+		{"Dockerfile", "", "Dockerfile"},
+		{"a:b:c", "a", "b:c"},
+	}
+
+	for _, tt := range tests {
+		dep, path := splitStepInput(tt.in)
+		if dep != tt.dep || path != tt.wantPath {
+			t.Errorf("splitStepInput(%q) = (%q, %q), want (%q, %q)", tt.in, dep, path, tt.dep, tt.wantPath)
+		}
+	}
+}
+
+func TestStepCacheKeyStability(t *testing.T) {
+	step := StepSpec{Cmd: []string{"make", "test"}, Params: []string{"RAILS_ENV"}, Inputs: []string{"build:bin"}}
+	params := types.Params{"RAILS_ENV": "test"}
+	hashes := map[string]string{"build:bin": "abc"}
+
+	k1, err := stepCacheKey("img", step, params, hashes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	k2, err := stepCacheKey("img", step, params, hashes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if k1 != k2 {
+		t.Errorf("expected stepCacheKey to be deterministic, got %q and %q", k1, k2)
+	}
+}
+
+func TestStepCacheKeyInputSensitivity(t *testing.T) {
+	step := StepSpec{Cmd: []string{"make", "test"}, Inputs: []string{"build:bin"}}
+	params := types.Params{}
+
+	k1, err := stepCacheKey("img", step, params, map[string]string{"build:bin": "abc"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	k2, err := stepCacheKey("img", step, params, map[string]string{"build:bin": "def"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if k1 == k2 {
+		t.Error("expected stepCacheKey to change when an input's content hash changes")
+	}
+}
+
+func TestStepCacheKeyParamSensitivity(t *testing.T) {
+	step := StepSpec{Cmd: []string{"make", "test"}, Params: []string{"RAILS_ENV"}}
+
+	k1, err := stepCacheKey("img", step, types.Params{"RAILS_ENV": "test"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	k2, err := stepCacheKey("img", step, types.Params{"RAILS_ENV": "production"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if k1 == k2 {
+		t.Error("expected stepCacheKey to change when a listed param changes")
+	}
+}
+
+func TestStepCacheKeyIgnoresUnlistedParams(t *testing.T) {
+	step := StepSpec{Cmd: []string{"make", "test"}, Params: []string{"RAILS_ENV"}}
+
+	k1, err := stepCacheKey("img", step, types.Params{"RAILS_ENV": "test", "OTHER": "x"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	k2, err := stepCacheKey("img", step, types.Params{"RAILS_ENV": "test", "OTHER": "y"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if k1 != k2 {
+		t.Error("expected stepCacheKey to ignore a param not listed in step.Params")
+	}
+}
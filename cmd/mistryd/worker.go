@@ -5,15 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"time"
 
 	_ "github.com/docker/distribution"
 	docker "github.com/docker/docker/client"
 	"github.com/skroutz/mistry/pkg/filesystem"
+	"github.com/skroutz/mistry/pkg/transport"
 	"github.com/skroutz/mistry/pkg/types"
 	"github.com/skroutz/mistry/pkg/utils"
 )
@@ -21,13 +24,51 @@ import (
 // Work performs the work denoted by j and returns a BuildResult upon
 // successful completion, or an error.
 func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResult, err error) {
-	log := log.New(os.Stderr, fmt.Sprintf("[worker] [%s] ", j), log.LstdFlags)
 	start := time.Now()
+	s.logger.Log(Event{Phase: "queued", JobID: j.ID, Project: j.Project, Group: j.Group})
+
+	defer func() {
+		ev := Event{
+			Phase:      "finalize",
+			JobID:      j.ID,
+			Project:    j.Project,
+			Group:      j.Group,
+			DurationMS: durationMS(time.Since(start)),
+		}
+		result := "success"
+		if buildResult != nil {
+			ev.ExitCode = &buildResult.ExitCode
+			ev.Cached = buildResult.Cached
+			ev.Coalesced = buildResult.Coalesced
+		}
+		if err != nil {
+			result = "error"
+			ev.Error = err.Error()
+		}
+		s.logger.Log(ev)
+		s.metrics.ObserveJob(j.Project, result)
+		s.metrics.ObservePhase("total", time.Since(start))
+	}()
+
+	pc, err := LoadProjectConfig(s.cfg.ProjectsPath, j.Project)
+	if err != nil && !os.IsNotExist(err) {
+		err = workErr("could not load project config", err)
+		return
+	}
+	if pc == nil {
+		pc = &ProjectConfig{}
+	}
+	if pc.Transport == "" {
+		pc.Transport = types.Rsync
+	}
+	j.Services = pc.Services
+
 	buildResult = &types.BuildResult{
 		Path:            filepath.Join(j.ReadyBuildPath, DataDir, ArtifactsDir),
-		TransportMethod: types.Rsync,
+		TransportMethod: pc.Transport,
 		Params:          j.Params,
 	}
+	err = nil
 
 	_, err = os.Stat(j.ReadyBuildPath)
 	if err == nil {
@@ -37,6 +78,7 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResu
 		}
 		buildResult.Cached = true
 		buildResult.ExitCode = i
+		s.metrics.ObserveCacheHit(j.Project)
 		return buildResult, err
 	} else if !os.IsNotExist(err) {
 		err = workErr("could not check for ready path", err)
@@ -47,31 +89,44 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResu
 	if added {
 		defer s.jq.Delete(j)
 	} else {
-		t := time.NewTicker(2 * time.Second)
+		// instead of polling for j.ReadyBuildPath on a timer, subscribe
+		// to the in-progress build's log output; every chunk we see is
+		// a cheap opportunity to recheck for completion, and a closed
+		// channel means the build finished (successfully or not).
+		chunks, unsubscribe := s.logs.Subscribe(j.ID)
+		defer unsubscribe()
 		log.Printf("Waiting for %s to complete...", j.PendingBuildPath)
+		t := time.NewTicker(2 * time.Second)
+		defer t.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				err = workErr("context cancelled while waiting for pending build", nil)
 				return
+			case <-chunks:
+				// either a log chunk arrived, or (if closed) the
+				// build finished; either way, recheck below.
 			case <-t.C:
-				_, err = os.Stat(j.ReadyBuildPath)
-				if err == nil {
-					i, err := ExitCode(j)
-					if err != nil {
-						return buildResult, err
-					}
-					buildResult.ExitCode = i
-					buildResult.Coalesced = true
+				// fallback in case we missed the close, e.g. the
+				// build failed before writing any output.
+			}
+			_, err = os.Stat(j.ReadyBuildPath)
+			if err == nil {
+				i, err := ExitCode(j)
+				if err != nil {
 					return buildResult, err
 				}
-				if os.IsNotExist(err) {
-					continue
-				} else {
-					err = workErr("could not wait for ready build", err)
-					return
-				}
+				buildResult.ExitCode = i
+				buildResult.Coalesced = true
+				s.metrics.ObserveCoalesceHit(j.Project)
+				s.logger.Log(Event{Phase: "coalesced", JobID: j.ID, Project: j.Project, Group: j.Group, DurationMS: durationMS(time.Since(start)), ExitCode: &buildResult.ExitCode})
+				return buildResult, err
 			}
+			if !os.IsNotExist(err) {
+				err = workErr("could not wait for ready build", err)
+				return
+			}
+			err = nil
 		}
 	}
 
@@ -109,8 +164,25 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResu
 		}
 	}
 
+	// a checkpoint can only be restored if this job's params are
+	// identical to the parent build's; any difference (e.g. a bumped
+	// dependency version) invalidates it and we fall back to a fresh
+	// run.
+	restoreFromCheckpoint := false
+	if s.cfg.Checkpoints && cloneSrc != "" {
+		restoreFromCheckpoint, err = paramsMatchParent(j, cloneSrc)
+		if err != nil {
+			log.Printf("could not compare params with parent build, skipping checkpoint restore: %s", err)
+			restoreFromCheckpoint = false
+		}
+		err = nil
+	}
+
 	log.Printf("Creating new build directory...")
-	shouldCleanup, err := bootstrapBuildDir(j, cloneSrc, s.cfg.FileSystem)
+	bootstrapStart := time.Now()
+	shouldCleanup, err := bootstrapBuildDir(j, cloneSrc, s.cfg.FileSystem, s.cfg.Checkpoints)
+	s.metrics.ObservePhase("bootstrap", time.Since(bootstrapStart))
+	s.logger.Log(Event{Phase: "bootstrap", JobID: j.ID, Project: j.Project, Group: j.Group, DurationMS: durationMS(time.Since(bootstrapStart))})
 	if shouldCleanup == true {
 		defer func() {
 			derr := s.cfg.FileSystem.Remove(j.PendingBuildPath)
@@ -159,14 +231,105 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResu
 		return
 	}
 
-	err = j.BuildImage(ctx, s.cfg.UID, client, out)
+	// tee the build's output through s.logs so clients tailing
+	// /jobs/{id}/logs?follow=1 see it live, in addition to it landing
+	// in the build log file.
+	teedOut := io.MultiWriter(out, s.logs.Writer(j.ID))
+	defer s.logs.Close(j.ID)
+
+	services, err := j.StartServices(ctx, client)
 	if err != nil {
+		err = workErr("could not start services", err)
 		return
 	}
+	defer func() {
+		serr := j.StopServices(ctx, client, services)
+		if serr != nil {
+			errstr := "could not stop services"
+			if err == nil {
+				err = fmt.Errorf("%s; %s", errstr, serr)
+			} else {
+				err = fmt.Errorf("%s; %s | %s", errstr, serr, err)
+			}
+		}
+	}()
+
+	if len(pc.Steps) > 0 {
+		// the build is a step DAG rather than a single opaque
+		// container; each step caches independently, so a param
+		// change that only affects e.g. the "test" step doesn't
+		// invalidate "build"'s cache.
+		var readyStepsDirs []string
+		if cloneSrc != "" {
+			readyStepsDirs = append(readyStepsDirs, cloneSrc)
+		}
+
+		stepsStart := time.Now()
+		var stepResults map[string]types.StepResult
+		stepResults, err = s.RunSteps(ctx, s.cfg, j, client, pc.Steps, readyStepsDirs, teedOut)
+		s.metrics.ObservePhase("container-run", time.Since(stepsStart))
+		s.logger.Log(Event{Phase: "container-run", JobID: j.ID, Project: j.Project, Group: j.Group, DurationMS: durationMS(time.Since(stepsStart))})
+		if err != nil {
+			err = workErr("could not run step DAG", err)
+			return
+		}
+		buildResult.Steps = stepResults
+		for _, name := range stepOrder(pc.Steps) {
+			buildResult.ExitCode = stepResults[name].ExitCode
+		}
+	} else {
+		imageBuildStart := time.Now()
+		err = j.BuildImage(ctx, s.cfg, client, teedOut)
+		s.metrics.ObservePhase("image-build", time.Since(imageBuildStart))
+		s.logger.Log(Event{Phase: "image-build", JobID: j.ID, Project: j.Project, Group: j.Group, DurationMS: durationMS(time.Since(imageBuildStart))})
+		if err != nil {
+			return
+		}
+
+		containerRunStart := time.Now()
+		checkpointPath := j.CheckpointPath(j.PendingBuildPath)
+		if restoreFromCheckpoint {
+			if _, serr := os.Stat(checkpointPath); serr == nil {
+				buildResult.ExitCode, err = j.RestoreFromCheckpoint(ctx, s.cfg, client, checkpointPath, teedOut)
+				buildResult.RestoredFrom = filepath.Base(cloneSrc)
+			} else {
+				log.Printf("no checkpoint found at %s, falling back to a fresh run", checkpointPath)
+				restoreFromCheckpoint = false
+			}
+		}
+		if !restoreFromCheckpoint {
+			// Checkpoint is taken (when enabled) as part of
+			// StartContainer, right after the container starts: the
+			// Docker checkpoint API rejects an already-exited
+			// container, so it can't be deferred until after this
+			// call returns.
+			var takeCheckpoint string
+			if s.cfg.Checkpoints {
+				takeCheckpoint = checkpointPath
+			}
+			buildResult.ExitCode, err = j.StartContainer(ctx, s.cfg, client, takeCheckpoint, teedOut)
+		}
+		s.metrics.ObservePhase("container-run", time.Since(containerRunStart))
+		s.logger.Log(Event{Phase: "container-run", JobID: j.ID, Project: j.Project, Group: j.Group, DurationMS: durationMS(time.Since(containerRunStart))})
+		if err != nil {
+			err = workErr("could not start docker container", err)
+			return
+		}
+	}
 
-	buildResult.ExitCode, err = j.StartContainer(ctx, s.cfg, client, out)
+	tr, err := transport.New(pc.Transport, pc.TransportConfig)
 	if err != nil {
-		err = workErr("could not start docker container", err)
+		err = workErr("could not initialize transport", err)
+		return
+	}
+	// Push reads from PendingBuildPath, which is where the artifacts
+	// still live at this point; it's renamed to ReadyBuildPath below.
+	// For Rsync this is moot: Push doesn't embed localPath in its URL,
+	// since that path goes stale the moment the rename happens (see
+	// Rsync.Push).
+	buildResult.TransportURL, err = tr.Push(ctx, j.ID, filepath.Join(j.PendingBuildPath, DataDir, ArtifactsDir))
+	if err != nil {
+		err = workErr("could not push artifacts", err)
 		return
 	}
 
@@ -218,11 +381,10 @@ func (s *Server) Work(ctx context.Context, j *Job) (buildResult *types.BuildResu
 		return
 	}
 
-	log.Println("Finished after", time.Now().Sub(start).Truncate(time.Millisecond))
 	return
 }
 
-func bootstrapBuildDir(j *Job, cloneSrc string, fs filesystem.FileSystem) (shouldCleanup bool, err error) {
+func bootstrapBuildDir(j *Job, cloneSrc string, fs filesystem.FileSystem, checkpoints bool) (shouldCleanup bool, err error) {
 	shouldCleanup = false
 	var (
 		cmd []string
@@ -230,6 +392,9 @@ func bootstrapBuildDir(j *Job, cloneSrc string, fs filesystem.FileSystem) (shoul
 	)
 
 	if cloneSrc != "" {
+		// cloning the whole build path also carries over cloneSrc's
+		// CheckpointDir, if any, which is exactly what lets Work
+		// restore from it below.
 		cmd = fs.Clone(cloneSrc, j.PendingBuildPath)
 	} else {
 		cmd = fs.Create(j.PendingBuildPath)
@@ -251,6 +416,16 @@ func bootstrapBuildDir(j *Job, cloneSrc string, fs filesystem.FileSystem) (shoul
 			err = workErr("could not remove params dir", err)
 			return
 		}
+
+		if !checkpoints {
+			// don't carry forward a stale checkpoint bundle into a
+			// project that no longer has checkpointing enabled.
+			err = os.RemoveAll(j.CheckpointPath(j.PendingBuildPath))
+			if err != nil {
+				err = workErr("could not remove stale checkpoint dir", err)
+				return
+			}
+		}
 	}
 
 	dirs := [4]string{
@@ -318,6 +493,26 @@ func ExitCode(j *Job) (int, error) {
 	return br.ExitCode, nil
 }
 
+// paramsMatchParent reports whether j's params are identical to the
+// params the build at cloneSrc (j's parent in the group) ran with, which
+// is the precondition for restoring cloneSrc's checkpoint instead of
+// running j's container from scratch.
+func paramsMatchParent(j *Job, cloneSrc string) (bool, error) {
+	br := new(types.BuildResult)
+	f, err := os.Open(filepath.Join(cloneSrc, BuildResultFname))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(br)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(br.Params, j.Params), nil
+}
+
 func workErr(s string, e error) error {
 	s = "work: " + s
 	if e != nil {
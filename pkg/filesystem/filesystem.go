@@ -0,0 +1,18 @@
+// Package filesystem abstracts the storage backend mistry uses for build
+// directories, so the worker doesn't need to know whether it's dealing
+// with plain directories, Btrfs subvolumes or something else.
+package filesystem
+
+// FileSystem is implemented by the various backends mistry can use to
+// store build directories.
+type FileSystem interface {
+	// Create returns the command that creates an empty build directory
+	// at dst.
+	Create(dst string) []string
+
+	// Clone returns the command that clones src into dst.
+	Clone(src, dst string) []string
+
+	// Remove removes the build directory rooted at path.
+	Remove(path string) error
+}
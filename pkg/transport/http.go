@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// HTTPConfig configures the HTTP transport.
+type HTTPConfig struct {
+	// BaseURL is where the server serves finished builds' artifacts
+	// from, e.g. https://mistry.example.com/artifacts.
+	BaseURL string
+}
+
+// HTTP serves artifacts over plain HTTP range-GET requests, for clients
+// that can reach the mistry server but not over rsync/SSH.
+type HTTP struct {
+	cfg HTTPConfig
+}
+
+// NewHTTP returns a new HTTP transport configured with cfg.
+func NewHTTP(cfg HTTPConfig) *HTTP {
+	return &HTTP{cfg: cfg}
+}
+
+// Push is a no-op for HTTP: artifacts stay where the build wrote them
+// and are served directly by the mistry server's HTTP API.
+func (h *HTTP) Push(ctx context.Context, jobID, localPath string) (string, error) {
+	return h.cfg.BaseURL + "/" + jobID, nil
+}
+
+// Pull fetches the artifacts at url, served as a tar stream by the
+// mistry server's HTTP API, and extracts them into localPath.
+func (h *HTTP) Pull(ctx context.Context, url, localPath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("could not build request: %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not fetch artifacts: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not fetch artifacts: unexpected status %s", resp.Status)
+	}
+
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read artifacts stream: %s", err)
+		}
+
+		target := filepath.Join(localPath, hdr.Name)
+		if rel, err := filepath.Rel(localPath, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid artifact entry %q: escapes %s", hdr.Name, localPath)
+		}
+
+		if hdr.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		cerr := f.Close()
+		if err != nil {
+			return fmt.Errorf("could not write %s: %s", target, err)
+		}
+		if cerr != nil {
+			return cerr
+		}
+	}
+}
+
+// Method returns types.HTTP.
+func (h *HTTP) Method() types.TransportMethod { return types.HTTP }
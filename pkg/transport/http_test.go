@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tarFixture(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("could not write tar header: %s", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("could not write tar content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("could not close tar writer: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHTTPPull(t *testing.T) {
+	files := map[string]string{
+		"artifact.txt":      "hello",
+		"sub/artifact2.txt": "world",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarFixture(t, files))
+	}))
+	defer srv.Close()
+
+	dst := t.TempDir()
+	h := NewHTTP(HTTPConfig{BaseURL: srv.URL})
+	err := h.Pull(context.Background(), srv.URL, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("could not read extracted file %q: %s", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("extracted file %q = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHTTPPullRejectsPathTraversal(t *testing.T) {
+	files := map[string]string{
+		"../../etc/passwd": "pwned",
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarFixture(t, files))
+	}))
+	defer srv.Close()
+
+	dst := t.TempDir()
+	h := NewHTTP(HTTPConfig{BaseURL: srv.URL})
+	err := h.Pull(context.Background(), srv.URL, dst)
+	if err == nil {
+		t.Fatal("expected an error for a tar entry escaping localPath, got nil")
+	}
+	if _, serr := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(dst)), "etc", "passwd")); !os.IsNotExist(serr) {
+		t.Error("tar entry escaped localPath and was written to disk")
+	}
+}
+
+func TestHTTPPullNon200(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	h := NewHTTP(HTTPConfig{BaseURL: srv.URL})
+	err := h.Pull(context.Background(), srv.URL, t.TempDir())
+	if err == nil {
+		t.Fatal("expected an error for a non-200 response, got nil")
+	}
+}
+
+func TestHTTPPushReturnsBaseURLJoinedWithJobID(t *testing.T) {
+	h := NewHTTP(HTTPConfig{BaseURL: "https://mistry.example.com/artifacts"})
+	url, err := h.Push(context.Background(), "job1", "/unused")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := "https://mistry.example.com/artifacts/job1"
+	if url != want {
+		t.Errorf("Push returned %q, want %q", url, want)
+	}
+}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/skroutz/mistry/pkg/types"
+	"github.com/skroutz/mistry/pkg/utils"
+)
+
+// RsyncConfig configures the Rsync transport.
+type RsyncConfig struct {
+	// Host is the host clients rsync artifacts from, typically the
+	// mistry server's own address.
+	Host string
+}
+
+// Rsync is the original, default transport: artifacts stay on the
+// server's filesystem and clients rsync(1) them over SSH.
+type Rsync struct {
+	cfg RsyncConfig
+}
+
+// NewRsync returns a new Rsync transport configured with cfg.
+func NewRsync(cfg RsyncConfig) *Rsync {
+	return &Rsync{cfg: cfg}
+}
+
+// Push is a no-op for Rsync: the artifacts already live at localPath,
+// and localPath is renamed into place shortly after Push returns (see
+// Server.Work), so it can't be embedded in the returned URL without
+// going stale. Clients rsync from types.BuildResult.Path instead, which
+// is why Push always returns an empty URL; see that field's doc.
+func (r *Rsync) Push(ctx context.Context, jobID, localPath string) (string, error) {
+	return "", nil
+}
+
+// Pull rsyncs the artifacts at url into localPath.
+func (r *Rsync) Pull(ctx context.Context, url, localPath string) error {
+	_, err := utils.RunCmd([]string{"rsync", "-a", url + "/", localPath})
+	return err
+}
+
+// Method returns types.Rsync.
+func (r *Rsync) Method() types.TransportMethod { return types.Rsync }
@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"context"
+
+	"github.com/skroutz/mistry/pkg/types"
+	"github.com/skroutz/mistry/pkg/utils"
+)
+
+// S3Config configures the S3 transport.
+type S3Config struct {
+	Bucket   string
+	Endpoint string
+	Region   string
+}
+
+// S3 pushes artifacts to an S3-compatible object store, for mistry
+// deployments where the server and its clients don't share a network
+// rsync-over-SSH can use (CI runners in different clouds, ephemeral k8s
+// pods, ...).
+type S3 struct {
+	cfg S3Config
+}
+
+// NewS3 returns a new S3 transport configured with cfg.
+func NewS3(cfg S3Config) *S3 {
+	return &S3{cfg: cfg}
+}
+
+// Push uploads the artifacts at localPath under a key derived from
+// jobID and returns their object URL.
+func (s *S3) Push(ctx context.Context, jobID, localPath string) (string, error) {
+	url := "s3://" + s.cfg.Bucket + "/" + jobID
+	_, err := utils.RunCmd(append(s.awsArgs(), "s3", "cp", "--recursive", localPath, url))
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// Pull downloads the artifacts at url into localPath.
+func (s *S3) Pull(ctx context.Context, url, localPath string) error {
+	_, err := utils.RunCmd(append(s.awsArgs(), "s3", "cp", "--recursive", url, localPath))
+	return err
+}
+
+// awsArgs returns the aws(1) invocation's leading args (the binary
+// itself plus any flags derived from s.cfg), before the subcommand.
+func (s *S3) awsArgs() []string {
+	args := []string{"aws"}
+	if s.cfg.Endpoint != "" {
+		args = append(args, "--endpoint-url", s.cfg.Endpoint)
+	}
+	if s.cfg.Region != "" {
+		args = append(args, "--region", s.cfg.Region)
+	}
+	return args
+}
+
+// Method returns types.S3.
+func (s *S3) Method() types.TransportMethod { return types.S3 }
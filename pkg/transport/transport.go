@@ -0,0 +1,72 @@
+// Package transport abstracts how build artifacts travel from the
+// mistry server to the client that requested the build, so that isn't
+// hardcoded to rsync-over-SSH.
+package transport
+
+import (
+	"context"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+// Transport pushes a finished build's artifacts somewhere a client can
+// later pull them from, and reports back the URL to do so.
+type Transport interface {
+	// Push uploads the artifacts at localPath (a build's ArtifactsDir)
+	// for job jobID and returns the URL clients should Pull from.
+	Push(ctx context.Context, jobID, localPath string) (url string, err error)
+
+	// Pull fetches the artifacts available at url into localPath.
+	Pull(ctx context.Context, url, localPath string) error
+
+	// Method returns the types.TransportMethod this Transport
+	// implements, so BuildResult.TransportMethod can be set correctly.
+	Method() types.TransportMethod
+}
+
+// New returns the Transport for method, configured with cfg.
+func New(method types.TransportMethod, cfg Config) (Transport, error) {
+	switch method {
+	case "", types.Rsync:
+		return NewRsync(cfg.Rsync), nil
+	case types.S3:
+		return NewS3(cfg.S3), nil
+	case types.HTTP:
+		return NewHTTP(cfg.HTTP), nil
+	default:
+		return nil, unknownMethodErr(method)
+	}
+}
+
+// Fetch fetches the artifacts a build reported at url into localPath,
+// dispatching to the Transport named by method. It's the client-side
+// counterpart of the server's tr.Push call in Server.Work: given a
+// types.BuildResult, a client fetches its artifacts via
+// Fetch(result.TransportMethod, cfg, result.TransportURL, localPath).
+func Fetch(method types.TransportMethod, cfg Config, url, localPath string) error {
+	tr, err := New(method, cfg)
+	if err != nil {
+		return err
+	}
+	return tr.Pull(context.Background(), url, localPath)
+}
+
+// Config holds the per-method configuration a project's mistry.yml may
+// supply for its chosen transport.
+type Config struct {
+	Rsync RsyncConfig
+	S3    S3Config
+	HTTP  HTTPConfig
+}
+
+func unknownMethodErr(method types.TransportMethod) error {
+	return &unknownMethodError{method}
+}
+
+type unknownMethodError struct {
+	method types.TransportMethod
+}
+
+func (e *unknownMethodError) Error() string {
+	return "unknown transport method: " + string(e.method)
+}
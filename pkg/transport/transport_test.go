@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/skroutz/mistry/pkg/types"
+)
+
+func TestNewDispatchesOnMethod(t *testing.T) {
+	tests := []struct {
+		method types.TransportMethod
+		want   types.TransportMethod
+	}{
+		{"", types.Rsync},
+		{types.Rsync, types.Rsync},
+		{types.S3, types.S3},
+		{types.HTTP, types.HTTP},
+	}
+
+	for _, tt := range tests {
+		tr, err := New(tt.method, Config{})
+		if err != nil {
+			t.Errorf("New(%q) returned an unexpected error: %s", tt.method, err)
+			continue
+		}
+		if got := tr.Method(); got != tt.want {
+			t.Errorf("New(%q).Method() = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestNewUnknownMethod(t *testing.T) {
+	_, err := New(types.TransportMethod("ftp"), Config{})
+	if err == nil {
+		t.Fatal("expected an error for an unknown transport method, got nil")
+	}
+}
+
+func TestFetchDispatchesToPull(t *testing.T) {
+	// Pull itself is exercised per-transport (e.g. TestHTTPPull); this
+	// only verifies Fetch wires method -> Transport.Pull instead of
+	// silently no-op'ing, which is what the original code never did.
+	dir := t.TempDir()
+	err := Fetch(types.Rsync, Config{}, "/does/not/exist", dir)
+	if err == nil {
+		t.Fatal("expected Fetch to propagate Pull's error for a nonexistent source, got nil")
+	}
+}
+
+func TestRsyncPushReturnsEmptyURL(t *testing.T) {
+	r := NewRsync(RsyncConfig{Host: "build.example.com"})
+	url, err := r.Push(context.Background(), "job1", "/some/pending/path")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if url != "" {
+		t.Errorf("expected Push to return an empty URL per types.BuildResult's documented contract, got %q", url)
+	}
+}
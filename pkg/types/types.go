@@ -0,0 +1,51 @@
+// Package types provides the data structures shared between the mistry
+// server and its clients.
+package types
+
+// TransportMethod denotes how build artifacts are transferred from the
+// mistry server to the client that requested the build.
+type TransportMethod string
+
+const (
+	// Rsync transfers artifacts using rsync(1) over SSH.
+	Rsync TransportMethod = "rsync"
+
+	// S3 transfers artifacts through an S3-compatible object store.
+	S3 TransportMethod = "s3"
+
+	// HTTP transfers artifacts over plain HTTP range-GET requests.
+	HTTP TransportMethod = "http"
+)
+
+// Params represents the parameters a build job was invoked with.
+type Params map[string]string
+
+// BuildResult is the outcome of a build job.
+type BuildResult struct {
+	Cached          bool            `json:"cached"`
+	Coalesced       bool            `json:"coalesced"`
+	ExitCode        int             `json:"exit_code"`
+	Path            string          `json:"path"`
+	TransportMethod TransportMethod `json:"transport_method"`
+	// TransportURL is where a client should Pull the artifacts from
+	// using TransportMethod. It's empty for the Rsync transport, whose
+	// Path doubles as the rsync source.
+	TransportURL string `json:"transport_url,omitempty"`
+	Params       Params `json:"params"`
+
+	// RestoredFrom is the build ID this build was restored from via a
+	// CRIU checkpoint, or empty if it ran from scratch.
+	RestoredFrom string `json:"restored_from,omitempty"`
+
+	// Steps holds the outcome of each step of the build, keyed by step
+	// name, for projects whose mistry.yml declares a build-step DAG.
+	// It's empty for projects that still run as a single opaque
+	// container, in which case ExitCode alone describes the build.
+	Steps map[string]StepResult `json:"steps,omitempty"`
+}
+
+// StepResult is the outcome of a single step of a build-step DAG.
+type StepResult struct {
+	ExitCode int  `json:"exit_code"`
+	Cached   bool `json:"cached"`
+}
@@ -0,0 +1,32 @@
+// Package utils provides small helpers shared across mistry's server and
+// client code.
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// RunCmd executes args and returns its combined output. If the command
+// fails, the returned error wraps the output so callers can surface it to
+// the user.
+func RunCmd(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command given")
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s failed: %s: %s", args[0], err, out)
+	}
+	return string(out), nil
+}
+
+// EnsureDirExists creates path if it doesn't already exist.
+func EnsureDirExists(path string) error {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return fmt.Errorf("could not ensure %s exists: %s", path, err)
+	}
+	return nil
+}